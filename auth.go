@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// AuthConfig is the top-level shape of the optional -authconfig YAML
+// file. Each section is independently optional; with the file omitted
+// entirely, /metrics stays unauthenticated as before.
+type AuthConfig struct {
+	TLS       *TLSConfig       `yaml:"tls"`
+	BasicAuth *BasicAuthConfig `yaml:"basic_auth"`
+	OIDC      *OIDCConfig      `yaml:"oidc"`
+
+	// AdminACL restricts which authenticated subjects or groups may hit
+	// admin endpoints such as /-/reload. Same semantics as a job's ACL:
+	// empty, or "*" as an entry, allows any authenticated subject.
+	AdminACL []string `yaml:"admin_acl"`
+}
+
+// TLSConfig names the server certificate the exporter's HTTP endpoint
+// should listen with.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// BasicAuthConfig points at an htpasswd-style file of "user:bcrypthash"
+// lines.
+type BasicAuthConfig struct {
+	HtpasswdFile string `yaml:"htpasswd_file"`
+}
+
+// OIDCConfig configures bearer-token verification against an OIDC
+// issuer. ClientID is required: it's checked against the token's "aud"
+// claim so a token minted for an unrelated application registered with
+// the same issuer is rejected. UsernameClaim defaults to "sub" and
+// GroupsClaim is optional.
+type OIDCConfig struct {
+	IssuerURL     string `yaml:"issuer_url"`
+	ClientID      string `yaml:"client_id"`
+	UsernameClaim string `yaml:"username_claim"`
+	GroupsClaim   string `yaml:"groups_claim"`
+}
+
+func loadAuthConfig(path string) (*AuthConfig, error) {
+	if path == "" {
+		return &AuthConfig{}, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg AuthConfig
+	if err = yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	return &cfg, nil
+}
+
+// subject identifies whoever authenticated a scrape request, for
+// matching against a job's ACL.
+type subject struct {
+	Name   string
+	Groups []string
+}
+
+// basicAuthenticator checks HTTP basic auth credentials against
+// bcrypt-hashed passwords loaded from an htpasswd-style file.
+type basicAuthenticator struct {
+	mu     sync.RWMutex
+	hashes map[string]string
+}
+
+func newBasicAuthenticator(htpasswdFile string) (*basicAuthenticator, error) {
+	b, err := ioutil.ReadFile(htpasswdFile)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		hashes[user] = hash
+	}
+	return &basicAuthenticator{hashes: hashes}, nil
+}
+
+func (a *basicAuthenticator) authenticate(req *http.Request) (*subject, bool) {
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	a.mu.RLock()
+	hash, exists := a.hashes[user]
+	a.mu.RUnlock()
+	if !exists {
+		return nil, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return nil, false
+	}
+	return &subject{Name: user}, true
+}
+
+// oidcAuthenticator verifies bearer tokens against an OIDC issuer and
+// maps the configured claims onto a subject.
+type oidcAuthenticator struct {
+	verifier      *oidc.IDTokenVerifier
+	usernameClaim string
+	groupsClaim   string
+}
+
+func newOIDCAuthenticator(ctx context.Context, cfg OIDCConfig) (*oidcAuthenticator, error) {
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("oidc.client_id is required")
+	}
+	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	if err != nil {
+		return nil, fmt.Errorf("discovering OIDC issuer '%s': %v", cfg.IssuerURL, err)
+	}
+	usernameClaim := cfg.UsernameClaim
+	if usernameClaim == "" {
+		usernameClaim = "sub"
+	}
+	return &oidcAuthenticator{
+		verifier:      provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		usernameClaim: usernameClaim,
+		groupsClaim:   cfg.GroupsClaim,
+	}, nil
+}
+
+func (a *oidcAuthenticator) authenticate(req *http.Request) (*subject, bool) {
+	header := req.Header.Get("Authorization")
+	rawToken, found := strings.CutPrefix(header, "Bearer ")
+	if !found {
+		return nil, false
+	}
+	idToken, err := a.verifier.Verify(req.Context(), rawToken)
+	if err != nil {
+		return nil, false
+	}
+	var claims map[string]interface{}
+	if err = idToken.Claims(&claims); err != nil {
+		return nil, false
+	}
+	name, _ := claims[a.usernameClaim].(string)
+	if name == "" {
+		return nil, false
+	}
+	var groups []string
+	if a.groupsClaim != "" {
+		if raw, exists := claims[a.groupsClaim]; exists {
+			if list, ok := raw.([]interface{}); ok {
+				for _, g := range list {
+					if s, ok := g.(string); ok {
+						groups = append(groups, s)
+					}
+				}
+			}
+		}
+	}
+	return &subject{Name: name, Groups: groups}, true
+}
+
+// authenticator aggregates whichever auth modes are configured. basic
+// auth and OIDC bearer tokens can be enabled together; a request is
+// authenticated if either accepts it.
+type authenticator struct {
+	basic *basicAuthenticator
+	oidc  *oidcAuthenticator
+}
+
+func newAuthenticator(ctx context.Context, cfg *AuthConfig) (*authenticator, error) {
+	a := &authenticator{}
+	if cfg.BasicAuth != nil {
+		basic, err := newBasicAuthenticator(cfg.BasicAuth.HtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading basic auth: %v", err)
+		}
+		a.basic = basic
+	}
+	if cfg.OIDC != nil {
+		oidcAuth, err := newOIDCAuthenticator(ctx, *cfg.OIDC)
+		if err != nil {
+			return nil, fmt.Errorf("configuring OIDC: %v", err)
+		}
+		a.oidc = oidcAuth
+	}
+	return a, nil
+}
+
+func (a *authenticator) enabled() bool {
+	return a.basic != nil || a.oidc != nil
+}
+
+func (a *authenticator) authenticate(req *http.Request) (*subject, bool) {
+	if a.oidc != nil {
+		if subj, ok := a.oidc.authenticate(req); ok {
+			return subj, true
+		}
+	}
+	if a.basic != nil {
+		if subj, ok := a.basic.authenticate(req); ok {
+			return subj, true
+		}
+	}
+	return nil, false
+}
+
+// jobAllowsSubject reports whether subj may scrape job, per job.ACL.
+func jobAllowsSubject(job Job, subj *subject) bool {
+	return aclAllows(job.ACL, subj)
+}
+
+// aclAllows reports whether subj's name or any of its groups appear in
+// acl. An empty acl, or "*" as one of its entries, allows any
+// authenticated subject.
+func aclAllows(acl []string, subj *subject) bool {
+	if len(acl) == 0 {
+		return true
+	}
+	for _, allowed := range acl {
+		if allowed == "*" || allowed == subj.Name {
+			return true
+		}
+		for _, g := range subj.Groups {
+			if allowed == g {
+				return true
+			}
+		}
+	}
+	return false
+}
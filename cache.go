@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Duration wraps time.Duration so it can be unmarshalled from YAML
+// strings like "30s" or "5m".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	if s == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration '%s': %v", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+var (
+	cacheHits   uint64
+	cacheMisses uint64
+	cacheStale  uint64
+)
+
+var metricCacheHits = &Metric{
+	Name: "zeno_query_exporter_cache_hits_total",
+	Help: "Number of /metrics scrapes served from the query result cache",
+	Type: counter,
+}
+
+var metricCacheMisses = &Metric{
+	Name: "zeno_query_exporter_cache_misses_total",
+	Help: "Number of /metrics scrapes that required running the ZenoDB query",
+	Type: counter,
+}
+
+var metricCacheStale = &Metric{
+	Name: "zeno_query_exporter_cache_stale_total",
+	Help: "Number of /metrics scrapes served from an expired cache entry because the refresh failed",
+	Type: counter,
+}
+
+// writeCacheMetrics reports the cache's cumulative hit/miss/stale
+// counters. It's called on every scrape, alongside the per-job metrics.
+func writeCacheMetrics(out io.Writer) {
+	ts := time.Now().UnixNano() / 1000000
+	writeMetric(out, float64(atomic.LoadUint64(&cacheHits)), ts, metricCacheHits, nil)
+	writeMetric(out, float64(atomic.LoadUint64(&cacheMisses)), ts, metricCacheMisses, nil)
+	writeMetric(out, float64(atomic.LoadUint64(&cacheStale)), ts, metricCacheStale, nil)
+}
+
+type cacheEntry struct {
+	body      []byte
+	expiresAt time.Time
+	staleAt   time.Time
+}
+
+// resultCache memoizes runJob's rendered output per cache key for up to
+// a job-configured TTL, coalescing concurrent misses for the same key
+// into a single upstream query via singleflight.
+type resultCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	group   singleflight.Group
+}
+
+func newResultCache() *resultCache {
+	return &resultCache{entries: make(map[string]*cacheEntry)}
+}
+
+// cacheKey hashes the job name and its extra query parameters into a
+// stable key, independent of parameter ordering.
+func cacheKey(job string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	fmt.Fprintf(h, "job=%s", job)
+	for _, k := range keys {
+		fmt.Fprintf(h, "|%s=%s", k, params[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns fetch's result for key, reusing a cached copy when it's
+// younger than ttl. ttl <= 0 disables caching entirely. If fetch fails
+// and staleOK > 0, a cached copy younger than ttl+staleOK is served
+// instead of the error.
+//
+// On a miss, concurrent callers sharing key coalesce onto a single
+// in-flight fetch via singleflight, and all of them receive its result.
+// Because of that, fetch must NOT be bound to any single caller's
+// request context/deadline — a short per-request timeout from whichever
+// caller happened to be the singleflight leader would otherwise silently
+// cancel every other caller's scrape too. Callers should build fetch
+// around a context scoped to the cache entry (e.g. the job's own
+// default timeout), not the inbound HTTP request's context.
+//
+// ctx is purely this caller's own wait budget: get races it against the
+// shared fetch completing and returns ctx.Err() the moment it expires,
+// without affecting fetch or any other caller waiting on the same key.
+func (c *resultCache) get(ctx context.Context, key string, ttl, staleOK time.Duration, fetch func() ([]byte, error)) ([]byte, error) {
+	if ttl <= 0 {
+		atomic.AddUint64(&cacheMisses, 1)
+		return fetch()
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	entry, exists := c.entries[key]
+	c.mu.Unlock()
+	if exists && now.Before(entry.expiresAt) {
+		atomic.AddUint64(&cacheHits, 1)
+		return entry.body, nil
+	}
+
+	type fetched struct {
+		body  []byte
+		stale bool
+	}
+	resultCh := c.group.DoChan(key, func() (interface{}, error) {
+		body, ferr := fetch()
+		if ferr != nil {
+			if exists && staleOK > 0 && now.Before(entry.staleAt) {
+				return fetched{body: entry.body, stale: true}, nil
+			}
+			return nil, ferr
+		}
+		c.mu.Lock()
+		c.entries[key] = &cacheEntry{
+			body:      body,
+			expiresAt: now.Add(ttl),
+			staleAt:   now.Add(ttl + staleOK),
+		}
+		c.mu.Unlock()
+		return fetched{body: body}, nil
+	})
+
+	select {
+	case res := <-resultCh:
+		if res.Err != nil {
+			atomic.AddUint64(&cacheMisses, 1)
+			return nil, res.Err
+		}
+		atomic.AddUint64(&cacheMisses, 1)
+		result := res.Val.(fetched)
+		if result.stale {
+			atomic.AddUint64(&cacheStale, 1)
+		}
+		return result.body, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var queryCache = newResultCache()
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/zenodb/core"
+	"github.com/getlantern/zenodb/rpc"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	defaultClusterName  = "default"
+	healthCheckInterval = 30 * time.Second
+	healthCheckTimeout  = 10 * time.Second
+	// healthCheckQuery only needs to round-trip to the server; its
+	// result is discarded, so a query error that isn't connection-level
+	// doesn't count against the endpoint's health.
+	healthCheckQuery = "SELECT 1"
+)
+
+// endpoint is a single ZenoDB connection within a cluster, along with
+// the health state runJob's failover logic and the internal metrics
+// need to track.
+type endpoint struct {
+	addr   string
+	client rpc.Client
+
+	mu       sync.Mutex
+	up       bool
+	lastErr  error
+	inFlight int64
+}
+
+func (ep *endpoint) markUp() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.up = true
+	ep.lastErr = nil
+}
+
+func (ep *endpoint) markDown(err error) {
+	ep.mu.Lock()
+	wasUp := ep.up
+	ep.up = false
+	ep.lastErr = err
+	ep.mu.Unlock()
+	// Logged rather than exposed as a metric label: the error text is
+	// unbounded and ever-changing, which would blow up label cardinality
+	// and, worse, may itself contain an unescaped '"' that would corrupt
+	// the rest of a /metrics response if written straight into a label.
+	if wasUp {
+		log.Printf("Endpoint '%s' marked down: %v", ep.addr, err)
+	}
+}
+
+func (ep *endpoint) state() (up bool, lastErr error, inFlight int64) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	return ep.up, ep.lastErr, atomic.LoadInt64(&ep.inFlight)
+}
+
+// cluster is a named group of ZenoDB endpoints that jobs route to by
+// name. Endpoints within a cluster are meant to be interchangeable
+// replicas of the same data.
+type cluster struct {
+	name      string
+	endpoints []*endpoint
+}
+
+func newCluster(name string, addrs []string, password string) (*cluster, error) {
+	cl := &cluster{name: name}
+	for _, addr := range addrs {
+		c, err := createClient(addr, password)
+		if err != nil {
+			return nil, fmt.Errorf("cluster '%s': connecting to '%s': %v", name, addr, err)
+		}
+		cl.endpoints = append(cl.endpoints, &endpoint{addr: addr, client: c, up: true})
+	}
+	return cl, nil
+}
+
+// healthyEndpoints returns the endpoints currently believed to be up,
+// in the order they should be tried.
+func (cl *cluster) healthyEndpoints() []*endpoint {
+	healthy := make([]*endpoint, 0, len(cl.endpoints))
+	for _, ep := range cl.endpoints {
+		up, _, _ := ep.state()
+		if up {
+			healthy = append(healthy, ep)
+		}
+	}
+	return healthy
+}
+
+// queryWithFailover invokes fn with each healthy endpoint's client in
+// turn (or with every endpoint's, when none is currently healthy), until
+// fn succeeds or every such candidate has been tried. Endpoints marked
+// down are not tried while any endpoint is up. A connection-level error advances to the
+// next endpoint; any other error is returned immediately since retrying
+// it elsewhere wouldn't help.
+func (cl *cluster) queryWithFailover(fn func(rpc.Client) error) error {
+	candidates := cl.healthyEndpoints()
+	if len(candidates) == 0 {
+		candidates = cl.endpoints
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("cluster '%s' has no endpoints", cl.name)
+	}
+	var lastErr error
+	for _, ep := range candidates {
+		atomic.AddInt64(&ep.inFlight, 1)
+		err := fn(ep.client)
+		atomic.AddInt64(&ep.inFlight, -1)
+		if err == nil {
+			ep.markUp()
+			return nil
+		}
+		if !isConnectionError(err) {
+			return err
+		}
+		ep.markDown(err)
+		lastErr = err
+	}
+	return lastErr
+}
+
+// isConnectionError reports whether err looks like it came from a
+// failed dial or a broken connection, as opposed to a query that was
+// successfully sent but failed or timed out server-side.
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, needle := range []string{"connection refused", "connection reset", "broken pipe", "no route to host", "eof", "transport is closing", "dial tcp"} {
+		if strings.Contains(msg, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+// startHealthChecks periodically runs a lightweight query against every
+// endpoint in every cluster, updating each endpoint's up/down state.
+func startHealthChecks(clusters map[string]*cluster) {
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, cl := range clusters {
+				for _, ep := range cl.endpoints {
+					go checkEndpointHealth(ep)
+				}
+			}
+		}
+	}()
+}
+
+func checkEndpointHealth(ep *endpoint) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	_, iterate, err := ep.client.Query(ctx, healthCheckQuery, true /*fresh*/)
+	if err != nil {
+		if isConnectionError(err) {
+			ep.markDown(err)
+		} else {
+			ep.markUp()
+		}
+		return
+	}
+	if iterate != nil {
+		iterate(func(row *core.FlatRow) (bool, error) { return false, nil })
+	}
+	ep.markUp()
+}
+
+// clustersConfig is the shape of the optional top-level config file
+// passed via -clusterconfig, naming additional ZenoDB clusters beyond
+// the one built from -zenoaddr.
+type clustersConfig struct {
+	Clusters map[string][]string `yaml:"clusters"`
+}
+
+// loadClusters builds the named cluster pool: a "default" cluster from
+// the comma-separated -zenoaddr flag, plus any clusters declared in
+// configPath.
+func loadClusters(defaultAddr, configPath, password string) (map[string]*cluster, error) {
+	clusters := make(map[string]*cluster)
+	if defaultAddr != "" {
+		addrs := strings.Split(defaultAddr, ",")
+		cl, err := newCluster(defaultClusterName, addrs, password)
+		if err != nil {
+			return nil, err
+		}
+		clusters[defaultClusterName] = cl
+	}
+	if configPath != "" {
+		b, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		var cfg clustersConfig
+		if err = yaml.Unmarshal(b, &cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", configPath, err)
+		}
+		for name, addrs := range cfg.Clusters {
+			cl, err := newCluster(name, addrs, password)
+			if err != nil {
+				return nil, err
+			}
+			clusters[name] = cl
+		}
+	}
+	if len(clusters) == 0 {
+		return nil, fmt.Errorf("no ZenoDB endpoints configured: pass -zenoaddr or -clusterconfig")
+	}
+	return clusters, nil
+}
+
+var metricEndpointUp = &Metric{
+	Name: "zeno_query_exporter_endpoint_up",
+	Help: "Whether the exporter currently considers a ZenoDB endpoint healthy",
+	Type: gauge,
+}
+
+var metricEndpointInFlight = &Metric{
+	Name: "zeno_query_exporter_endpoint_in_flight_queries",
+	Help: "Number of queries currently in flight to a ZenoDB endpoint",
+	Type: gauge,
+}
+
+// writeClusterMetrics reports per-endpoint up/down and in-flight-query
+// state across every cluster. Called on every scrape, alongside the
+// per-job metrics.
+func writeClusterMetrics(out io.Writer, clusters map[string]*cluster) {
+	ts := time.Now().UnixNano() / 1000000
+	for name, cl := range clusters {
+		for _, ep := range cl.endpoints {
+			up, _, inFlight := ep.state()
+			labels := map[string]string{"cluster": name, "endpoint": ep.addr}
+			upValue := 0.0
+			if up {
+				upValue = 1.0
+			}
+			writeMetric(out, upValue, ts, metricEndpointUp, labels)
+			writeMetric(out, float64(inFlight), ts, metricEndpointInFlight, map[string]string{"cluster": name, "endpoint": ep.addr})
+		}
+	}
+}
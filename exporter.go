@@ -7,18 +7,37 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strconv"
 	"text/template"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
 	"github.com/getlantern/zenodb/core"
 	"github.com/getlantern/zenodb/rpc"
 )
 
+// maxSpanQueryLen caps how much of a rendered query we attach to a span,
+// so a pathological template doesn't blow up trace payload size.
+const maxSpanQueryLen = 2048
+
+func truncateForSpan(s string) string {
+	if len(s) <= maxSpanQueryLen {
+		return s
+	}
+	return s[:maxSpanQueryLen] + "...(truncated)"
+}
+
 type metricType string
 
 const (
-	counter metricType = "counter"
-	gauge   metricType = "gauge"
+	counter   metricType = "counter"
+	gauge     metricType = "gauge"
+	histogram metricType = "histogram"
+	summary   metricType = "summary"
 )
 
 type Metric struct {
@@ -31,6 +50,22 @@ type Metric struct {
 	// Extra labels applied to this particular metric in addition to
 	// those mapped from dimentions.
 	ExtraLabels map[string]string
+
+	// Buckets lists the histogram's upper bounds, in increasing order.
+	// BucketColumns maps 1:1 with Buckets, naming the ZenoDB value column
+	// that holds each bucket's cumulative count. CountColumn and
+	// SumColumn name the columns backing the _count and _sum series.
+	// Only used when Type is histogram.
+	Buckets       []float64
+	BucketColumns []string `yaml:"bucket_columns"`
+	CountColumn   string   `yaml:"count_column"`
+	SumColumn     string   `yaml:"sum_column"`
+
+	// Quantiles maps a quantile label (e.g. "0.99") to the ZenoDB value
+	// column holding that quantile's value. CountColumn and SumColumn
+	// above double as the summary's _count/_sum companion series. Only
+	// used when Type is summary.
+	Quantiles map[string]string `yaml:"quantiles"`
 }
 
 type Job struct {
@@ -40,8 +75,30 @@ type Job struct {
 	// RenameDims maps the ZenoDB dimensions to Prometheus labels. Other
 	// dimensions except those IgnoreDims are mapped to labels as they are.
 	RenameDims map[string]string
-	// Metrics maps the ZenoDB values to Prometheus metrics
+	// Metrics maps ZenoDB values to Prometheus metrics. For counter and
+	// gauge metrics the map key is the ZenoDB value column backing the
+	// metric. For histogram and summary metrics, which are backed by
+	// several columns (see BucketColumns/CountColumn/SumColumn/
+	// Quantiles on Metric), the key is just an identifier for the
+	// metric and isn't matched against a column directly.
 	Metrics map[string]*Metric
+
+	// CacheTTL is how long a scrape's result is reused for subsequent
+	// scrapes of the same job with the same parameters. Zero disables
+	// caching for this job.
+	CacheTTL Duration `yaml:"cache_ttl"`
+	// StaleOK extends an expired cache entry's lifetime for use as a
+	// fallback if the refresh query fails or times out.
+	StaleOK Duration `yaml:"stale_ok"`
+
+	// Cluster names which ZenoDB cluster this job's query runs against.
+	// Defaults to defaultClusterName.
+	Cluster string `yaml:"cluster"`
+
+	// ACL restricts which authenticated subjects or groups may scrape
+	// this job, when an auth mode is configured. An empty ACL, or "*"
+	// as one of its entries, allows any authenticated subject.
+	ACL []string `yaml:"acl"`
 }
 
 type Config struct {
@@ -58,6 +115,55 @@ var metricMissingPartitions = &Metric{
 	Type: gauge,
 }
 
+// validateMetric checks that a histogram or summary metric is internally
+// consistent (monotonically increasing buckets, required companion
+// columns present). Counter and gauge metrics need no extra validation.
+func validateMetric(name string, metric *Metric) error {
+	switch metric.Type {
+	case histogram:
+		if len(metric.Buckets) == 0 {
+			return fmt.Errorf("metric '%s' is a histogram but declares no buckets", name)
+		}
+		if len(metric.Buckets) != len(metric.BucketColumns) {
+			return fmt.Errorf("metric '%s' has %d buckets but %d bucket_columns", name, len(metric.Buckets), len(metric.BucketColumns))
+		}
+		for i := 1; i < len(metric.Buckets); i++ {
+			if metric.Buckets[i] <= metric.Buckets[i-1] {
+				return fmt.Errorf("metric '%s' buckets must be strictly increasing, got %v", name, metric.Buckets)
+			}
+		}
+		if metric.CountColumn == "" || metric.SumColumn == "" {
+			return fmt.Errorf("metric '%s' is a histogram but is missing count_column/sum_column", name)
+		}
+	case summary:
+		if len(metric.Quantiles) == 0 {
+			return fmt.Errorf("metric '%s' is a summary but declares no quantiles", name)
+		}
+		if metric.CountColumn == "" || metric.SumColumn == "" {
+			return fmt.Errorf("metric '%s' is a summary but is missing count_column/sum_column", name)
+		}
+	}
+	return nil
+}
+
+// requiredColumns returns the ZenoDB value columns that metric needs
+// present in a query result's field names.
+func requiredColumns(metric *Metric) []string {
+	switch metric.Type {
+	case histogram:
+		cols := append([]string{}, metric.BucketColumns...)
+		return append(cols, metric.CountColumn, metric.SumColumn)
+	case summary:
+		cols := make([]string, 0, len(metric.Quantiles)+2)
+		for _, col := range metric.Quantiles {
+			cols = append(cols, col)
+		}
+		return append(cols, metric.CountColumn, metric.SumColumn)
+	default:
+		return nil
+	}
+}
+
 func createClient(addr, password string) (rpc.Client, error) {
 	host, _, _ := net.SplitHostPort(addr)
 	tlsConfig := &tls.Config{
@@ -78,7 +184,13 @@ func createClient(addr, password string) (rpc.Client, error) {
 	})
 }
 
-func runJob(ctx context.Context, client rpc.Client, name string, job Job, params map[string]string, out io.Writer) error {
+func runJob(ctx context.Context, cl *cluster, name string, job Job, params map[string]string, out io.Writer) error {
+	ctx, jobSpan := tracer.Start(ctx, "runJob", trace.WithAttributes(
+		attribute.String("job", name),
+		attribute.String("params", fmt.Sprintf("%v", params)),
+	))
+	defer jobSpan.End()
+
 	if job.RenameDims == nil {
 		job.RenameDims = make(map[string]string)
 	}
@@ -87,64 +199,185 @@ func runJob(ctx context.Context, client rpc.Client, name string, job Job, params
 	}
 	query := job.Query
 	if len(params) > 0 {
+		_, renderSpan := tracer.Start(ctx, "render_template")
 		t, err := template.New("").Parse(job.Query)
 		if err != nil {
+			renderSpan.RecordError(err)
+			renderSpan.End()
 			return err
 		}
 		var buf bytes.Buffer
 		if err = t.Execute(&buf, params); err != nil {
+			renderSpan.RecordError(err)
+			renderSpan.End()
 			return err
 		}
 		query = buf.String()
-		fmt.Printf("Executing query:\n%s", query)
+		renderSpan.SetAttributes(attribute.String("query", truncateForSpan(query)))
+		renderSpan.End()
+		logWithSpan(ctx).Debug("rendered query template", "job", name)
 	}
-	md, iterate, err := client.Query(ctx, query, true /*fresh*/)
-	if err != nil {
-		return err
-	}
-	stats, err := iterate(func(row *core.FlatRow) (bool, error) {
-		labels := make(map[string]string)
-		for dim, value := range row.Key.AsMap() {
-			vs := fmt.Sprintf("%v", value)
-			renamed, exists := job.RenameDims[dim]
-			if exists {
-				if renamed != "" {
-					labels[renamed] = vs
+	jobSpan.SetAttributes(attribute.String("query", truncateForSpan(query)))
+
+	return cl.queryWithFailover(func(client rpc.Client) error {
+		// attemptBuf collects this attempt's output separately from out.
+		// If the endpoint fails partway through iterate (after some rows
+		// were already written), queryWithFailover retries the whole
+		// closure against the next endpoint; writing straight to out
+		// would leave the first attempt's partial series in the response
+		// alongside the retry's, corrupting the Prometheus text format.
+		// Only a fully successful attempt's buffer is copied to out.
+		var attemptBuf bytes.Buffer
+		attemptOut := &attemptBuf
+
+		queryCtx, querySpan := tracer.Start(ctx, "zenodb.query", trace.WithAttributes(
+			attribute.String("query", truncateForSpan(query)),
+		))
+		md, iterate, err := client.Query(queryCtx, query, true /*fresh*/)
+		querySpan.End()
+		if err != nil {
+			jobSpan.RecordError(err)
+			jobSpan.SetStatus(codes.Error, err.Error())
+			return err
+		}
+
+		colIdx := make(map[string]int, len(md.FieldNames))
+		for idx, fieldName := range md.FieldNames {
+			colIdx[fieldName] = idx
+		}
+		for _, metric := range job.Metrics {
+			for _, col := range requiredColumns(metric) {
+				if _, exists := colIdx[col]; !exists {
+					return fmt.Errorf("metric '%s' requires column '%s', which is missing from the query result", metric.Name, col)
 				}
-			} else {
-				labels[dim] = vs
 			}
 		}
-		idxToMetric := make(map[int]*Metric)
-		for idx, name := range md.FieldNames {
-			if metric, exists := job.Metrics[name]; exists {
-				idxToMetric[idx] = metric
+
+		_, iterateSpan := tracer.Start(ctx, "iterate_rows")
+		rowCount := 0
+		stats, err := iterate(func(row *core.FlatRow) (bool, error) {
+			_, rowSpan := tracer.Start(ctx, "process_row")
+			defer rowSpan.End()
+			rowCount++
+
+			labels := make(map[string]string)
+			for dim, value := range row.Key.AsMap() {
+				vs := fmt.Sprintf("%v", value)
+				renamed, exists := job.RenameDims[dim]
+				if exists {
+					if renamed != "" {
+						labels[renamed] = vs
+					}
+				} else {
+					labels[dim] = vs
+				}
 			}
-		}
 
-		for i, v := range row.Values {
-			if metric, exists := idxToMetric[i]; exists {
-				writeMetric(out, float64(v), row.TS/1000000, metric, labels)
+			for _, metric := range job.Metrics {
+				switch metric.Type {
+				case histogram:
+					bucketValues := make([]float64, len(metric.Buckets))
+					for i, col := range metric.BucketColumns {
+						bucketValues[i] = float64(row.Values[colIdx[col]])
+					}
+					count := float64(row.Values[colIdx[metric.CountColumn]])
+					sum := float64(row.Values[colIdx[metric.SumColumn]])
+					writeHistogramMetric(attemptOut, row.TS/1000000, metric, bucketValues, count, sum, labels)
+				case summary:
+					quantileValues := make(map[string]float64, len(metric.Quantiles))
+					for q, col := range metric.Quantiles {
+						quantileValues[q] = float64(row.Values[colIdx[col]])
+					}
+					count := float64(row.Values[colIdx[metric.CountColumn]])
+					sum := float64(row.Values[colIdx[metric.SumColumn]])
+					writeSummaryMetric(attemptOut, row.TS/1000000, metric, quantileValues, count, sum, labels)
+				}
 			}
+
+			idxToMetric := make(map[int]*Metric)
+			for idx, name := range md.FieldNames {
+				if metric, exists := job.Metrics[name]; exists && metric.Type != histogram && metric.Type != summary {
+					idxToMetric[idx] = metric
+				}
+			}
+			for i, v := range row.Values {
+				if metric, exists := idxToMetric[i]; exists {
+					writeMetric(attemptOut, float64(v), row.TS/1000000, metric, labels)
+				}
+			}
+			return true, nil
+		})
+		iterateSpan.SetAttributes(attribute.Int("rows", rowCount))
+		iterateSpan.End()
+		if err != nil {
+			jobSpan.RecordError(err)
+			jobSpan.SetStatus(codes.Error, err.Error())
+			return err
 		}
-		return true, nil
-	})
-	if err != nil {
+		jobSpan.SetAttributes(
+			attribute.Int("rows", rowCount),
+			attribute.Int64("zeno.num_partitions", int64(stats.NumPartitions)),
+			attribute.Int64("zeno.num_successful_partitions", int64(stats.NumSuccessfulPartitions)),
+		)
+		labels := map[string]string{"job": name}
+		ts := time.Now().UnixNano() / 1000000
+		writeMetric(attemptOut, float64(stats.NumPartitions), ts, metricTotalPartitions, labels)
+		writeMetric(attemptOut, float64(stats.NumPartitions-stats.NumSuccessfulPartitions), ts, metricMissingPartitions, labels)
+
+		// Only now, with the whole attempt having succeeded, does its
+		// output get appended to the real out.
+		_, err = attemptBuf.WriteTo(out)
 		return err
+	})
+}
+
+func writeMetric(out io.Writer, metric float64, timpstampMs int64, meta *Metric, labels map[string]string) {
+	writeMetricHeader(out, meta)
+	writeSeries(out, meta.Name, metric, timpstampMs, labels, meta.ExtraLabels, nil)
+}
+
+// writeHistogramMetric emits a Prometheus histogram: one cumulative
+// "_bucket" series per declared bound plus an auto-emitted "+Inf"
+// bucket, followed by the "_count" and "_sum" companion series.
+func writeHistogramMetric(out io.Writer, timestampMs int64, meta *Metric, bucketValues []float64, count, sum float64, labels map[string]string) {
+	writeMetricHeader(out, meta)
+	for i, bound := range meta.Buckets {
+		writeSeries(out, meta.Name+"_bucket", bucketValues[i], timestampMs, labels, meta.ExtraLabels, map[string]string{"le": formatBound(bound)})
 	}
-	labels := map[string]string{"job": name}
-	ts := time.Now().UnixNano() / 1000000
-	writeMetric(out, float64(stats.NumPartitions), ts, metricTotalPartitions, labels)
-	writeMetric(out, float64(stats.NumPartitions-stats.NumSuccessfulPartitions), ts, metricMissingPartitions, labels)
+	writeSeries(out, meta.Name+"_bucket", count, timestampMs, labels, meta.ExtraLabels, map[string]string{"le": "+Inf"})
+	writeSeries(out, meta.Name+"_count", count, timestampMs, labels, meta.ExtraLabels, nil)
+	writeSeries(out, meta.Name+"_sum", sum, timestampMs, labels, meta.ExtraLabels, nil)
+}
 
-	return nil
+// writeSummaryMetric emits a Prometheus summary: one series per
+// quantile, in ascending quantile order, followed by the "_count" and
+// "_sum" companion series.
+func writeSummaryMetric(out io.Writer, timestampMs int64, meta *Metric, quantileValues map[string]float64, count, sum float64, labels map[string]string) {
+	writeMetricHeader(out, meta)
+	quantiles := make([]string, 0, len(quantileValues))
+	for q := range quantileValues {
+		quantiles = append(quantiles, q)
+	}
+	sort.Slice(quantiles, func(i, j int) bool {
+		qi, _ := strconv.ParseFloat(quantiles[i], 64)
+		qj, _ := strconv.ParseFloat(quantiles[j], 64)
+		return qi < qj
+	})
+	for _, q := range quantiles {
+		writeSeries(out, meta.Name, quantileValues[q], timestampMs, labels, meta.ExtraLabels, map[string]string{"quantile": q})
+	}
+	writeSeries(out, meta.Name+"_count", count, timestampMs, labels, meta.ExtraLabels, nil)
+	writeSeries(out, meta.Name+"_sum", sum, timestampMs, labels, meta.ExtraLabels, nil)
 }
 
-func writeMetric(out io.Writer, metric float64, timpstampMs int64, meta *Metric, labels map[string]string) {
-	hasLabel := len(labels) > 0 || len(meta.ExtraLabels) > 0
+func writeMetricHeader(out io.Writer, meta *Metric) {
 	fmt.Fprintf(out, "# HELP %s %s\n", meta.Name, meta.Help)
 	fmt.Fprintf(out, "# TYPE %s %s\n", meta.Name, meta.Type)
-	fmt.Fprint(out, meta.Name)
+}
+
+func writeSeries(out io.Writer, name string, value float64, timestampMs int64, labels, extraLabels, ownLabels map[string]string) {
+	hasLabel := len(labels) > 0 || len(extraLabels) > 0 || len(ownLabels) > 0
+	io.WriteString(out, name)
 	if hasLabel {
 		io.WriteString(out, "{")
 		comma := false
@@ -159,10 +392,19 @@ func writeMetric(out io.Writer, metric float64, timpstampMs int64, meta *Metric,
 		for name, value := range labels {
 			writeLabel(name, value)
 		}
-		for name, value := range meta.ExtraLabels {
+		for name, value := range extraLabels {
+			writeLabel(name, value)
+		}
+		for name, value := range ownLabels {
 			writeLabel(name, value)
 		}
 		io.WriteString(out, "}")
 	}
-	fmt.Fprintf(out, " %f %d\n", metric, timpstampMs)
+	fmt.Fprintf(out, " %f %d\n", value, timestampMs)
+}
+
+// formatBound renders a histogram bound the way Prometheus' own client
+// libraries do, trimming unnecessary trailing zeros.
+func formatBound(bound float64) string {
+	return strconv.FormatFloat(bound, 'g', -1, 64)
 }
@@ -1,56 +1,78 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
+	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"path"
-	"path/filepath"
-	"strings"
 	"time"
 
-	yaml "gopkg.in/yaml.v2"
-
-	"github.com/getlantern/zenodb/rpc"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
-	jobsPath = flag.String("jobspath", ".", "The path of the job definitions. *.yaml files under the path will be loaded.")
-	zenoAddr = flag.String("zenoaddr", "", "The ZenoDB address to which to connect with gRPC over TLS")
-	password = flag.String("password", "", "The password used to authenticate against ZenoDB server")
-	addr     = flag.String("addr", "", "The address to which the exporter HTTP service listens on")
-	strict   = flag.Bool("strict", true, "if specified, raises error when there are missing data from 1 or more partitions")
+	jobsPath      = flag.String("jobspath", ".", "The path of the job definitions. *.yaml files under the path will be loaded.")
+	zenoAddr      = flag.String("zenoaddr", "", "Comma-separated list of ZenoDB addresses making up the default cluster, each dialed with gRPC over TLS")
+	clusterConfig = flag.String("clusterconfig", "", "Optional path to a YAML file declaring additional named ZenoDB clusters for jobs to route to")
+	password      = flag.String("password", "", "The password used to authenticate against ZenoDB server")
+	addr          = flag.String("addr", "", "The address to which the exporter HTTP service listens on")
+	strict        = flag.Bool("strict", true, "if specified, raises error when there are missing data from 1 or more partitions")
+	otlpEndpoint  = flag.String("otlp-endpoint", "", "Address of an OTLP/gRPC collector to export job execution traces to. Tracing is disabled if unset")
+	authConfig    = flag.String("authconfig", "", "Optional path to a YAML file configuring TLS, basic auth, and/or OIDC for the exporter's HTTP endpoint")
 )
 
-var jobs map[string]Job = make(map[string]Job)
-var client rpc.Client
+var clusters map[string]*cluster
+var auth *authenticator
+var adminACL []string
 
 const defaultJobTimeout = 3 * time.Minute
 
 func main() {
 	flag.Parse()
 	checkFlags()
-	var err error
-	err = loadJobs(*jobsPath)
+	ctx := context.Background()
+	shutdownTracing, err := setupTracing(ctx, *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdownTracing(ctx)
+
+	err = reloadJobs(*jobsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	watchJobs(*jobsPath)
+	clusters, err = loadClusters(*zenoAddr, *clusterConfig, *password)
 	if err != nil {
 		log.Fatal(err)
 	}
-	client, err = createClient(*zenoAddr, *password)
+	startHealthChecks(clusters)
+
+	authCfg, err := loadAuthConfig(*authConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth, err = newAuthenticator(ctx, authCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	adminACL = authCfg.AdminACL
 
 	http.Handle("/metrics", http.HandlerFunc(handleMetrics))
+	http.Handle("/-/reload", http.HandlerFunc(handleReload))
 	log.Printf("Starting Zeno Query Exporter at %s", *addr)
+	if authCfg.TLS != nil {
+		log.Fatal(http.ListenAndServeTLS(*addr, authCfg.TLS.CertFile, authCfg.TLS.KeyFile, nil))
+	}
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
 
 func checkFlags() {
-	if *zenoAddr == "" {
-		log.Fatal("Missing zenoaddr")
+	if *zenoAddr == "" && *clusterConfig == "" {
+		log.Fatal("Missing zenoaddr or clusterconfig")
 	}
 	if *password == "" {
 		log.Fatal("Missing password")
@@ -60,30 +82,35 @@ func checkFlags() {
 	}
 }
 
-func loadJobs(jobsPath string) error {
-	files, err := filepath.Glob(path.Join(jobsPath, "*.yaml"))
-	if err != nil {
-		return err
-	}
-	for _, p := range files {
-		fname := path.Base(p)
-		name := strings.Split(fname, ".")[0]
-		b, err := ioutil.ReadFile(p)
-		if err != nil {
-			return err
-		}
-		var job Job
-		err = yaml.Unmarshal(b, &job)
-		if err != nil {
-			return err
-		}
-		log.Printf("Loaded job '%s'", name)
-		jobs[name] = job
+func resolveCluster(job Job) (*cluster, error) {
+	name := job.Cluster
+	if name == "" {
+		name = defaultClusterName
+	}
+	cl, exists := clusters[name]
+	if !exists {
+		return nil, fmt.Errorf("no such cluster '%s'", name)
 	}
-	return nil
+	return cl, nil
 }
 
 func handleMetrics(rw http.ResponseWriter, req *http.Request) {
+	ctx, span := tracer.Start(req.Context(), "handleMetrics")
+	defer span.End()
+
+	var subj *subject
+	if auth.enabled() {
+		var ok bool
+		subj, ok = auth.authenticate(req)
+		if !ok {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="zeno_query_exporter"`)
+			rw.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(rw, "authentication required\n")
+			return
+		}
+		span.SetAttributes(attribute.String("subject", subj.Name))
+	}
+
 	query := req.URL.Query()
 	name := query.Get("job")
 	if name == "" {
@@ -91,12 +118,24 @@ func handleMetrics(rw http.ResponseWriter, req *http.Request) {
 		io.WriteString(rw, "job not specified\n")
 		return
 	}
-	job, exists := jobs[name]
+	span.SetAttributes(attribute.String("job", name))
+	job, exists := currentJobs()[name]
 	if !exists {
 		rw.WriteHeader(http.StatusNotFound)
 		io.WriteString(rw, "job not found\n")
 		return
 	}
+	if auth.enabled() && !jobAllowsSubject(job, subj) {
+		rw.WriteHeader(http.StatusForbidden)
+		io.WriteString(rw, "not authorized for this job\n")
+		return
+	}
+	cl, err := resolveCluster(job)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(rw, "%v\n", err)
+		return
+	}
 	timeout, err := time.ParseDuration(query.Get("timeout"))
 	if err != nil {
 		timeout = defaultJobTimeout
@@ -107,17 +146,44 @@ func handleMetrics(rw http.ResponseWriter, req *http.Request) {
 	for k, l := range query {
 		params[k] = l[0]
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	span.SetAttributes(attribute.String("params", fmt.Sprintf("%v", params)))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
-	err = runJob(ctx, client, job, params, rw)
+
+	// fetchCtx is what actually drives the (possibly cache-coalesced)
+	// query. When caching is enabled, a cache miss may be shared with
+	// other callers via singleflight, so it must not be scoped to this
+	// one caller's own ?timeout= — otherwise whichever request happens
+	// to be the singleflight leader would silently impose its deadline
+	// on every other waiter. Bound it by the job's default timeout
+	// instead; only fall back to this caller's own ctx when caching is
+	// off and there's nothing to share.
+	fetchCtx := ctx
+	if time.Duration(job.CacheTTL) > 0 {
+		var fetchCancel context.CancelFunc
+		fetchCtx, fetchCancel = context.WithTimeout(context.Background(), defaultJobTimeout)
+		defer fetchCancel()
+	}
+	body, err := queryCache.get(ctx, cacheKey(name, params), time.Duration(job.CacheTTL), time.Duration(job.StaleOK), func() ([]byte, error) {
+		var buf bytes.Buffer
+		if runErr := runJob(fetchCtx, cl, name, job, params, &buf); runErr != nil {
+			return nil, runErr
+		}
+		return buf.Bytes(), nil
+	})
 	if err != nil {
+		span.RecordError(err)
 		select {
 		case <-ctx.Done():
 			rw.WriteHeader(http.StatusGatewayTimeout)
-			log.Printf("Job '%s' timed out", name)
+			logWithSpan(ctx).Error("job timed out", "job", name)
 		default:
 			rw.WriteHeader(http.StatusInternalServerError)
-			log.Printf("Job '%s' failed: %v", name, err)
+			logWithSpan(ctx).Error("job failed", "job", name, "error", err)
 		}
+		return
 	}
+	rw.Write(body)
+	writeCacheMetrics(rw)
+	writeClusterMetrics(rw, clusters)
 }
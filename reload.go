@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// jobsStore holds the currently active map[string]Job. It's swapped
+// atomically on a successful reload so handleMetrics never observes a
+// half-loaded configuration.
+var jobsStore atomic.Value
+
+func init() {
+	jobsStore.Store(make(map[string]Job))
+}
+
+func currentJobs() map[string]Job {
+	return jobsStore.Load().(map[string]Job)
+}
+
+// readJobs parses every *.yaml file under jobsPath into a fresh jobs
+// map, validating each one, without touching the currently active map.
+// A single bad file fails the whole reload.
+func readJobs(jobsPath string) (map[string]Job, error) {
+	files, err := filepath.Glob(path.Join(jobsPath, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(map[string]Job, len(files))
+	for _, p := range files {
+		fname := path.Base(p)
+		name := strings.Split(fname, ".")[0]
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var job Job
+		if err = yaml.Unmarshal(b, &job); err != nil {
+			return nil, fmt.Errorf("job '%s': %v", name, err)
+		}
+		for metricName, metric := range job.Metrics {
+			if err = validateMetric(metricName, metric); err != nil {
+				return nil, fmt.Errorf("job '%s': %v", name, err)
+			}
+		}
+		loaded[name] = job
+	}
+	return loaded, nil
+}
+
+// reloadJobs reloads and validates every job file under jobsPath and,
+// only if all of them parse and validate cleanly, atomically swaps them
+// in as the active configuration.
+func reloadJobs(jobsPath string) error {
+	loaded, err := readJobs(jobsPath)
+	if err != nil {
+		return err
+	}
+	jobsStore.Store(loaded)
+	for name := range loaded {
+		log.Printf("Loaded job '%s'", name)
+	}
+	log.Printf("Reloaded %d job(s) from %s", len(loaded), jobsPath)
+	return nil
+}
+
+// watchJobs triggers reloadJobs on SIGHUP and on fsnotify events under
+// jobsPath, logging (but not failing on) reload errors so a single bad
+// edit doesn't bring down the exporter.
+func watchJobs(jobsPath string) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Printf("Received SIGHUP, reloading jobs from %s", jobsPath)
+			if err := reloadJobs(jobsPath); err != nil {
+				log.Printf("Reload failed: %v", err)
+			}
+		}
+	}()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Could not start job file watcher: %v", err)
+		return
+	}
+	if err = watcher.Add(jobsPath); err != nil {
+		log.Printf("Could not watch %s: %v", jobsPath, err)
+		return
+	}
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !strings.HasSuffix(event.Name, ".yaml") {
+					continue
+				}
+				log.Printf("Detected change to %s, reloading jobs", event.Name)
+				if err := reloadJobs(jobsPath); err != nil {
+					log.Printf("Reload failed: %v", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Job file watcher error: %v", err)
+			}
+		}
+	}()
+}
+
+// handleReload implements an admin endpoint matching the convention
+// used by the Prometheus server itself: POST to trigger a reload, 200
+// on success, 4xx with the parse error in the body on failure. When an
+// auth mode is configured, it's enforced here too (against admin_acl)
+// so a shared, multi-tenant exporter can't be reloaded anonymously.
+func handleReload(rw http.ResponseWriter, req *http.Request) {
+	if auth.enabled() {
+		subj, ok := auth.authenticate(req)
+		if !ok {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="zeno_query_exporter"`)
+			rw.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(rw, "authentication required\n")
+			return
+		}
+		if !aclAllows(adminACL, subj) {
+			rw.WriteHeader(http.StatusForbidden)
+			io.WriteString(rw, "not authorized to reload\n")
+			return
+		}
+	}
+	if req.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(rw, "only POST is allowed on this endpoint\n")
+		return
+	}
+	if err := reloadJobs(*jobsPath); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(rw, "failed to reload jobs: %v\n", err)
+		return
+	}
+	rw.WriteHeader(http.StatusOK)
+}
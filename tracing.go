@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("zeno_query_exporter")
+
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// setupTracing wires a trace.TracerProvider exporting spans via
+// OTLP/gRPC to otlpEndpoint, returning a shutdown func to flush
+// buffered spans on exit. With no endpoint configured, tracing stays a
+// no-op: spans are created but go nowhere.
+func setupTracing(ctx context.Context, otlpEndpoint string) (func(context.Context) error, error) {
+	if otlpEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exp, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(otlpEndpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %v", err)
+	}
+	res, err := resource.New(ctx, resource.WithAttributes(attribute.String("service.name", "zeno_query_exporter")))
+	if err != nil {
+		return nil, fmt.Errorf("creating OTel resource: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// logWithSpan returns a logger annotated with ctx's trace/span IDs, if
+// any, so an operator can correlate a logged job timeout or failure
+// with what happened server-side during that same trace.
+func logWithSpan(ctx context.Context) *slog.Logger {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return logger
+	}
+	return logger.With("trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+}